@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// currentPM2Collector/pm2CollectorKeys track the PM2Collector instance
+// currently registered, so rebuildPM2Collector can tell whether a config
+// reload actually changed the label schema before re-registering.
+var (
+	pm2CollectorMu      sync.Mutex
+	currentPM2Collector *PM2Collector
+	pm2CollectorKeys    []string
+)
+
+// configReloadTotal and configReloadLastSuccess track --config.file reload
+// outcomes so alerts can fire on a config that stopped reloading cleanly.
+var (
+	configReloadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pm2_exporter_config_reload_total",
+		Help: "Count of --config.file reload attempts, labeled by result.",
+	}, []string{"result"})
+
+	configReloadLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pm2_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful --config.file reload.",
+	})
+)
+
+// rawConfig is the on-disk YAML shape for --config.file.
+type rawConfig struct {
+	Filters struct {
+		Include []string `yaml:"include"`
+		Exclude []string `yaml:"exclude"`
+	} `yaml:"filters"`
+	ExtraLabels map[string]string `yaml:"extra_labels"`
+	Rewrites    []struct {
+		Pattern string            `yaml:"pattern"`
+		Labels  map[string]string `yaml:"labels"`
+	} `yaml:"rewrites"`
+}
+
+// rewriteRule maps PM2 process names matching Pattern into structured
+// labels, e.g. "myapp-worker-3" -> {app: "myapp", role: "worker", shard: "3"}
+// via regexp capture groups referenced as "${1}" in the label templates.
+type rewriteRule struct {
+	pattern *regexp.Regexp
+	labels  map[string]string
+}
+
+// compiledConfig is the validated, ready-to-use form of rawConfig, swapped
+// in atomically by reloadConfig. The zero value behaves as "no config file":
+// everything is allowed, no extra labels.
+type compiledConfig struct {
+	include     []*regexp.Regexp
+	exclude     []*regexp.Regexp
+	extraLabels map[string]string
+	rewrites    []rewriteRule
+}
+
+// reservedLabelNames are the label names PM2Collector's descriptors always
+// carry (see NewPM2Collector). extra_labels/rewrites keys that collide with
+// one of these would make prometheus.NewDesc report a duplicate label name,
+// which panics MustRegister in rebuildPM2Collector — so loadConfig rejects
+// them up front instead.
+var reservedLabelNames = map[string]struct{}{
+	"process":  {},
+	"pid":      {},
+	"status":   {},
+	"branch":   {},
+	"revision": {},
+	"comment":  {},
+}
+
+var emptyConfig = &compiledConfig{}
+
+var configStore atomic.Value // holds *compiledConfig
+
+func init() {
+	configStore.Store(emptyConfig)
+}
+
+// currentConfig returns the most recently loaded config, or emptyConfig if
+// --config.file was never set.
+func currentConfig() *compiledConfig {
+	return configStore.Load().(*compiledConfig)
+}
+
+// allows reports whether a process name passes the include/exclude filters.
+func (c *compiledConfig) allows(name string) bool {
+	for _, re := range c.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelKeys returns the sorted, de-duplicated set of label names contributed
+// by extra_labels and all rewrite rules, used to size PM2Collector's descriptors.
+func (c *compiledConfig) labelKeys() []string {
+	seen := map[string]struct{}{}
+	for k := range c.extraLabels {
+		seen[k] = struct{}{}
+	}
+	for _, r := range c.rewrites {
+		for k := range r.labels {
+			seen[k] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelValues resolves name's extra_labels plus the first matching rewrite
+// rule's labels, in the order given by keys (as produced by labelKeys), with
+// "" for any key that doesn't apply to this process.
+func (c *compiledConfig) labelValues(name string, keys []string) []string {
+	values := make(map[string]string, len(keys))
+	for k, v := range c.extraLabels {
+		values[k] = v
+	}
+	for _, r := range c.rewrites {
+		m := r.pattern.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+		for k, tmpl := range r.labels {
+			values[k] = string(r.pattern.ExpandString(nil, tmpl, name, m))
+		}
+		break
+	}
+
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = values[k]
+	}
+	return out
+}
+
+// loadConfig reads and compiles path into a compiledConfig.
+func loadConfig(path string) (*compiledConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	var raw rawConfig
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	for label := range raw.ExtraLabels {
+		if _, reserved := reservedLabelNames[label]; reserved {
+			return nil, fmt.Errorf("extra_labels: label %q is a reserved built-in label name", label)
+		}
+	}
+
+	cfg := &compiledConfig{extraLabels: raw.ExtraLabels}
+
+	for _, pattern := range raw.Filters.Include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filters.include %q: %w", pattern, err)
+		}
+		cfg.include = append(cfg.include, re)
+	}
+	for _, pattern := range raw.Filters.Exclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filters.exclude %q: %w", pattern, err)
+		}
+		cfg.exclude = append(cfg.exclude, re)
+	}
+	for _, rw := range raw.Rewrites {
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrites pattern %q: %w", rw.Pattern, err)
+		}
+		for label := range rw.Labels {
+			if _, reserved := reservedLabelNames[label]; reserved {
+				return nil, fmt.Errorf("rewrites pattern %q: label %q is a reserved built-in label name", rw.Pattern, label)
+			}
+		}
+		cfg.rewrites = append(cfg.rewrites, rewriteRule{pattern: re, labels: rw.Labels})
+	}
+
+	return cfg, nil
+}
+
+// rebuildPM2Collector swaps the registered PM2Collector for one whose
+// descriptors match cfg's label set, if that set has changed.
+func rebuildPM2Collector(registry *prometheus.Registry, cfg *compiledConfig) {
+	newKeys := cfg.labelKeys()
+
+	pm2CollectorMu.Lock()
+	defer pm2CollectorMu.Unlock()
+
+	if pm2CollectorKeys != nil && stringsEqual(pm2CollectorKeys, newKeys) {
+		return
+	}
+	if currentPM2Collector != nil {
+		registry.Unregister(currentPM2Collector)
+	}
+	currentPM2Collector = NewPM2Collector(newKeys)
+	registry.MustRegister(currentPM2Collector)
+	pm2CollectorKeys = newKeys
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadConfig loads path, and on success atomically publishes it and
+// rebuilds the PM2Collector if its label set changed.
+func reloadConfig(path string, registry *prometheus.Registry) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		log.Printf("config reload failed: %v", err)
+		configReloadTotal.WithLabelValues("failure").Inc()
+		return
+	}
+
+	configStore.Store(cfg)
+	rebuildPM2Collector(registry, cfg)
+
+	configReloadTotal.WithLabelValues("success").Inc()
+	configReloadLastSuccess.Set(float64(time.Now().Unix()))
+	log.Printf("loaded config from %s (%d include, %d exclude, %d rewrites)",
+		path, len(cfg.include), len(cfg.exclude), len(cfg.rewrites))
+}
+
+// watchConfigFile reloads path on every write/create/rename/remove event,
+// re-arming the watch on the directory so editors that replace the file via
+// rename (instead of an in-place write) are still picked up.
+func watchConfigFile(path string, registry *prometheus.Registry) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("config watcher: failed to start fsnotify: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("config watcher: failed to watch %s: %v", dir, err)
+		return
+	}
+
+	base := filepath.Base(path)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != base {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			if event.Op&fsnotify.Remove != 0 || event.Op&fsnotify.Rename != 0 {
+				// Give the editor a moment to finish writing the replacement file.
+				time.Sleep(50 * time.Millisecond)
+			}
+			reloadConfig(path, registry)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("config watcher error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestCompiledConfigAllows(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  *compiledConfig
+		proc string
+		want bool
+	}{
+		{
+			name: "no filters allows everything",
+			cfg:  &compiledConfig{},
+			proc: "anything",
+			want: true,
+		},
+		{
+			name: "include matches",
+			cfg:  &compiledConfig{include: []*regexp.Regexp{regexp.MustCompile(`^web-`)}},
+			proc: "web-1",
+			want: true,
+		},
+		{
+			name: "include without match excludes",
+			cfg:  &compiledConfig{include: []*regexp.Regexp{regexp.MustCompile(`^web-`)}},
+			proc: "worker-1",
+			want: false,
+		},
+		{
+			name: "exclude wins over a matching include",
+			cfg: &compiledConfig{
+				include: []*regexp.Regexp{regexp.MustCompile(`^web-`)},
+				exclude: []*regexp.Regexp{regexp.MustCompile(`-canary$`)},
+			},
+			proc: "web-canary",
+			want: false,
+		},
+		{
+			name: "exclude applies even with no include list",
+			cfg:  &compiledConfig{exclude: []*regexp.Regexp{regexp.MustCompile(`^internal-`)}},
+			proc: "internal-cron",
+			want: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cfg.allows(tc.proc); got != tc.want {
+				t.Errorf("allows(%q) = %v, want %v", tc.proc, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompiledConfigLabelValues(t *testing.T) {
+	cfg := &compiledConfig{
+		extraLabels: map[string]string{"env": "prod"},
+		rewrites: []rewriteRule{
+			{
+				pattern: regexp.MustCompile(`^(\w+)-worker-(\d+)$`),
+				labels:  map[string]string{"app": "${1}", "role": "worker", "shard": "${2}"},
+			},
+			{
+				// Overlaps with the rule above for names like "myapp-worker-3":
+				// first-match-wins means this rule should never apply to them.
+				pattern: regexp.MustCompile(`^myapp-`),
+				labels:  map[string]string{"app": "fallback-should-not-win"},
+			},
+		},
+	}
+	keys := cfg.labelKeys()
+
+	got := cfg.labelValues("myapp-worker-3", keys)
+	want := map[string]string{"env": "prod", "app": "myapp", "role": "worker", "shard": "3"}
+	assertLabelValues(t, keys, got, want)
+
+	// No rewrite matches "other-svc": only extra_labels apply, rewrite keys are "".
+	got = cfg.labelValues("other-svc", keys)
+	want = map[string]string{"env": "prod", "app": "", "role": "", "shard": ""}
+	assertLabelValues(t, keys, got, want)
+}
+
+func assertLabelValues(t *testing.T, keys, got []string, want map[string]string) {
+	t.Helper()
+	if len(got) != len(keys) {
+		t.Fatalf("labelValues returned %d values for %d keys", len(got), len(keys))
+	}
+	for i, k := range keys {
+		if got[i] != want[k] {
+			t.Errorf("label %q = %q, want %q", k, got[i], want[k])
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	yaml := `
+filters:
+  include:
+    - "^web-"
+  exclude:
+    - "-canary$"
+extra_labels:
+  env: prod
+rewrites:
+  - pattern: "^(\\w+)-worker-(\\d+)$"
+    labels:
+      app: "${1}"
+      shard: "${2}"
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.allows("web-1") {
+		t.Error("expected web-1 to be allowed")
+	}
+	if cfg.allows("web-canary") {
+		t.Error("expected web-canary to be excluded")
+	}
+	if cfg.allows("worker-1") {
+		t.Error("expected worker-1 to fail the include filter")
+	}
+	if len(cfg.rewrites) != 1 {
+		t.Fatalf("expected 1 rewrite rule, got %d", len(cfg.rewrites))
+	}
+}
+
+func TestLoadConfigMalformedRegex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	yaml := `
+filters:
+  include:
+    - "("
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	if _, err := loadConfig(path); err == nil {
+		t.Error("expected loadConfig to fail on a malformed include regex")
+	}
+}
+
+func TestLoadConfigRejectsReservedLabelNames(t *testing.T) {
+	cases := []struct {
+		name string
+		yaml string
+	}{
+		{
+			name: "extra_labels collides with a built-in label",
+			yaml: `
+extra_labels:
+  status: prod
+`,
+		},
+		{
+			name: "rewrite labels collides with a built-in label",
+			yaml: `
+rewrites:
+  - pattern: "^(\\w+)-worker-(\\d+)$"
+    labels:
+      pid: "${1}"
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.yml")
+			if err := os.WriteFile(path, []byte(tc.yaml), 0o644); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			if _, err := loadConfig(path); err == nil {
+				t.Error("expected loadConfig to reject a label colliding with a reserved built-in label name")
+			}
+		})
+	}
+}
+
+func TestParsePushGrouping(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]string
+	}{
+		{name: "empty", in: "", want: map[string]string{}},
+		{name: "single pair", in: "instance=web-1", want: map[string]string{"instance": "web-1"}},
+		{
+			name: "multiple pairs with spacing",
+			in:   "instance=web-1, env = prod",
+			want: map[string]string{"instance": "web-1", "env": "prod"},
+		},
+		{
+			name: "malformed pair is skipped, valid ones kept",
+			in:   "instance=web-1,garbage,env=prod",
+			want: map[string]string{"instance": "web-1", "env": "prod"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parsePushGrouping(tc.in)
+			if len(got) != len(tc.want) {
+				t.Fatalf("parsePushGrouping(%q) = %v, want %v", tc.in, got, tc.want)
+			}
+			for k, v := range tc.want {
+				if got[k] != v {
+					t.Errorf("parsePushGrouping(%q)[%q] = %q, want %q", tc.in, k, got[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dataMaxStaleness gates pm2_up: once the last successful fetch is older than
+// this, pm2_up flips to 0 even if fetchPM2Data hasn't errored again yet.
+// Zero disables the staleness check.
+var dataMaxStaleness = flag.Duration("data.max-staleness", 0, `Maximum age of the last successful PM2 fetch before pm2_up flips to 0, e.g. "5m". 0 disables staleness checking.`)
+
+// scrapeFailuresTotal counts failed fetchPM2Data calls.
+var scrapeFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pm2_exporter_scrape_failures_total",
+	Help: "Total number of failed PM2 data fetches.",
+})
+
+// scrapeStats holds the outcome of the most recent fetchPM2Data call.
+// fetched stays false until the first fetchPM2DataTimed call returns, so
+// Collect can tell "never scraped yet" apart from "last scrape succeeded"
+// instead of defaulting lastErr's zero value into a false pm2_up=1.
+type scrapeStats struct {
+	mu       sync.Mutex
+	duration time.Duration
+	lastErr  bool
+	fetched  bool
+}
+
+var lastScrape scrapeStats
+
+func (s *scrapeStats) record(duration time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duration = duration
+	s.lastErr = err != nil
+	s.fetched = true
+}
+
+func (s *scrapeStats) snapshot() (duration time.Duration, lastErr bool, fetched bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duration, s.lastErr, s.fetched
+}
+
+// fetchPM2DataTimed wraps fetchPM2Data, recording its duration/outcome into
+// lastScrape and scrapeFailuresTotal for the health metrics below.
+func fetchPM2DataTimed() error {
+	start := time.Now()
+	err := fetchPM2Data()
+	lastScrape.record(time.Since(start), err)
+	if err != nil {
+		scrapeFailuresTotal.Inc()
+	}
+	return err
+}
+
+// HealthCollector exposes scraper-health metrics so a Prometheus alert can
+// tell that pm2 jlist/rpc has been failing, or that the last-good data is
+// stale, rather than silently serving reservation values forever.
+type HealthCollector struct {
+	up              *prometheus.Desc
+	lastScrapeError *prometheus.Desc
+	scrapeDuration  *prometheus.Desc
+	dataAgeSeconds  *prometheus.Desc
+}
+
+// NewHealthCollector builds a HealthCollector with its metric descriptors.
+func NewHealthCollector() *HealthCollector {
+	return &HealthCollector{
+		up:              prometheus.NewDesc("pm2_up", "1 if the last PM2 fetch succeeded and the data isn't stale, 0 otherwise (including before the first fetch completes).", nil, nil),
+		lastScrapeError: prometheus.NewDesc("pm2_exporter_last_scrape_error", "1 if the last PM2 fetch failed, 0 otherwise.", nil, nil),
+		scrapeDuration:  prometheus.NewDesc("pm2_exporter_last_scrape_duration_seconds", "Duration of the last PM2 fetch, in seconds.", nil, nil),
+		dataAgeSeconds:  prometheus.NewDesc("pm2_exporter_data_age_seconds", "Seconds since the last successful PM2 fetch.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *HealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.lastScrapeError
+	ch <- c.scrapeDuration
+	ch <- c.dataAgeSeconds
+}
+
+// Collect implements prometheus.Collector.
+func (c *HealthCollector) Collect(ch chan<- prometheus.Metric) {
+	duration, lastErr, fetched := lastScrape.snapshot()
+	age := time.Since(pm2Data.lastFetchTime())
+
+	up := 1.0
+	if !fetched || lastErr {
+		up = 0
+	}
+	if *dataMaxStaleness > 0 && age > *dataMaxStaleness {
+		up = 0
+	}
+
+	var lastErrVal float64
+	if lastErr {
+		lastErrVal = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(c.lastScrapeError, prometheus.GaugeValue, lastErrVal)
+	ch <- prometheus.MustNewConstMetric(c.scrapeDuration, prometheus.GaugeValue, duration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.dataAgeSeconds, prometheus.GaugeValue, age.Seconds())
+}
@@ -8,9 +8,17 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
 )
 
 // PM2Process describes each process from `pm2 jlist`.
@@ -36,33 +44,54 @@ type PM2Process struct {
 	} `json:"monit"`
 }
 
-// SafePM2Data holds the data plus a timestamp.
+// SafePM2Data holds the data plus a timestamp, guarded by mu.
 type SafePM2Data struct {
+	mu        sync.Mutex
 	processes []PM2Process
 	lastFetch time.Time
 }
 
+func (d *SafePM2Data) set(procs []PM2Process) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.processes = procs
+	d.lastFetch = time.Now()
+}
+
+func (d *SafePM2Data) snapshot() []PM2Process {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	procs := make([]PM2Process, len(d.processes))
+	copy(procs, d.processes)
+	return procs
+}
+
+func (d *SafePM2Data) lastFetchTime() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastFetch
+}
+
 var (
 	// CLI flags
 	listenAddress  = flag.String("web.listen-address", ":9966", "Address on which to expose metrics and web interface (e.g. :9966).")
-	scrapeInterval = flag.Int("web.scrape-interval", 30, "How often (in seconds) to run `pm2 jlist` in the background.")
+	scrapeInterval = flag.Int("web.scrape-interval", 30, "How often (in seconds) to poll PM2 in the background.")
 	showHelp       = flag.Bool("help", false, "Show usage and exit.")
+	pushGatewayURL = flag.String("push.gateway-url", "", "Pushgateway URL to push metrics to after each scrape (e.g. http://pushgateway:9091). Disabled if empty.")
+	pushJob        = flag.String("push.job", "pm2_exporter", "Job name to push metrics under.")
+	pushGrouping   = flag.String("push.grouping", "", `Comma-separated key=value grouping labels for the push, e.g. "instance=web-1,env=prod".`)
+	configFile     = flag.String("config.file", "", "Path to a YAML file declaring process include/exclude filters, extra labels, and name-based label rewrites. Hot-reloaded via fsnotify. Disabled if empty.")
 
 	pm2Data SafePM2Data
 )
 
-// sanitizeLabelValue ensures we don't break the Prometheus text format.
-func sanitizeLabelValue(s string) string {
-	s = strings.ReplaceAll(s, "\n", " ")
-	s = strings.ReplaceAll(s, "\r", " ")
-	s = strings.ReplaceAll(s, "\t", " ")
-	// Escape double quotes
-	s = strings.ReplaceAll(s, `"`, `\"`)
-	return s
+// fetchPM2Data refreshes pm2Data by running `pm2 jlist`.
+func fetchPM2Data() error {
+	return fetchPM2DataExec()
 }
 
-// fetchPM2Data runs `pm2 jlist` and updates pm2Data.
-func fetchPM2Data() error {
+// fetchPM2DataExec runs `pm2 jlist` and updates pm2Data.
+func fetchPM2DataExec() error {
 	cmd := exec.Command("pm2", "jlist")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -74,178 +103,248 @@ func fetchPM2Data() error {
 		return fmt.Errorf("failed to parse pm2 jlist JSON: %v", err)
 	}
 
-	pm2Data.processes = procs
-	pm2Data.lastFetch = time.Now()
+	pm2Data.set(procs)
 	return nil
 }
 
-// buildMetricsText composes the final text for `/metrics`.
-func buildMetricsText() string {
-	var sb strings.Builder
+// PM2Collector implements prometheus.Collector over the polled pm2Data.
+// extraKeys are the config-driven label names (from extra_labels and
+// rewrites) appended after the built-in labels; they're fixed for the
+// lifetime of a PM2Collector instance, see rebuildPM2Collector.
+type PM2Collector struct {
+	extraKeys  []string
+	status     *prometheus.Desc
+	branchInfo *prometheus.Desc
+	memory     *prometheus.Desc
+	cpu        *prometheus.Desc
+	uptime     *prometheus.Desc
+	restarts   *prometheus.Desc
+	createdAt  *prometheus.Desc
+}
 
-	// Collect lines for each metric
-	var statusLines []string
-	var branchLines []string
-	var memoryLines []string
-	var cpuLines []string
-	var uptimeLines []string
-	var restartLines []string
-	var createdAtLines []string
+// NewPM2Collector builds a PM2Collector with its metric descriptors. extraKeys
+// is the set of additional label names contributed by the active config file.
+func NewPM2Collector(extraKeys []string) *PM2Collector {
+	labels := append([]string{"process", "pid"}, extraKeys...)
+	return &PM2Collector{
+		extraKeys: extraKeys,
+		status: prometheus.NewDesc(
+			"pm2_status",
+			`PM2 App process status: 1 if "online", 0 otherwise; label "status" shows the textual status`,
+			append(append([]string{}, labels...), "status"), nil,
+		),
+		branchInfo: prometheus.NewDesc(
+			"pm2_branch_info",
+			"PM2 App processes branch, revision, and comment: 1 if branch is non-empty, else 0",
+			append(append([]string{}, labels...), "branch", "revision", "comment"), nil,
+		),
+		memory: prometheus.NewDesc(
+			"pm2_memory_bytes",
+			"PM2 App process memory usage in bytes",
+			labels, nil,
+		),
+		cpu: prometheus.NewDesc(
+			"pm2_cpu_percent",
+			"PM2 App process CPU usage in percentage",
+			labels, nil,
+		),
+		uptime: prometheus.NewDesc(
+			"pm2_uptime_seconds",
+			`PM2 App process uptime in seconds (calculated from "pm_uptime")`,
+			labels, nil,
+		),
+		restarts: prometheus.NewDesc(
+			"pm2_restart_count",
+			"Number of restarts for a PM2 App process",
+			labels, nil,
+		),
+		createdAt: prometheus.NewDesc(
+			"pm2_created_at_timestamp",
+			"PM2 App process creation time in epoch milliseconds",
+			labels, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *PM2Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.status
+	ch <- c.branchInfo
+	ch <- c.memory
+	ch <- c.cpu
+	ch <- c.uptime
+	ch <- c.restarts
+	ch <- c.createdAt
+}
 
-	for _, p := range pm2Data.processes {
-		pidStr := strconv.Itoa(p.PID)
+// Collect implements prometheus.Collector, walking the last-fetched pm2Data
+// snapshot and applying the active config's include/exclude filters and
+// label remapping.
+func (c *PM2Collector) Collect(ch chan<- prometheus.Metric) {
+	cfg := currentConfig()
+
+	for _, p := range pm2Data.snapshot() {
+		if !cfg.allows(p.Name) {
+			continue
+		}
+		pidStr := fmt.Sprintf("%d", p.PID)
+		extraVals := cfg.labelValues(p.Name, c.extraKeys)
+		lv := func(rest ...string) []string {
+			return append(append([]string{p.Name, pidStr}, extraVals...), rest...)
+		}
 
-		// pm2_status: 1 if status == "online", else 0
 		var statusVal float64
 		if p.PM2Env.Status == "online" {
 			statusVal = 1
-		} else {
-			statusVal = 0
 		}
-		safeStatus := sanitizeLabelValue(p.PM2Env.Status)
-		statusLines = append(statusLines, fmt.Sprintf(
-			`pm2_status{process="%s",pid="%s",status="%s"} %g`,
-			p.Name, pidStr, safeStatus, statusVal,
-		))
+		ch <- prometheus.MustNewConstMetric(c.status, prometheus.GaugeValue, statusVal, lv(p.PM2Env.Status)...)
 
-		// pm2_branch_info: 1 if branch != "", else 0
 		var branchValue float64
 		if p.PM2Env.Versioning.Branch != "" {
 			branchValue = 1
 		}
-		branchVal := sanitizeLabelValue(p.PM2Env.Versioning.Branch)
-		revisionVal := sanitizeLabelValue(p.PM2Env.Versioning.Revision)
-		commentVal := sanitizeLabelValue(p.PM2Env.Versioning.Comment)
-		branchLines = append(branchLines, fmt.Sprintf(
-			`pm2_branch_info{process="%s",pid="%s",branch="%s",revision="%s",comment="%s"} %g`,
-			p.Name, pidStr, branchVal, revisionVal, commentVal, branchValue,
-		))
-
-		// pm2_memory_bytes
-		memoryLines = append(memoryLines, fmt.Sprintf(
-			`pm2_memory_bytes{process="%s",pid="%s"} %d`,
-			p.Name, pidStr, p.Monit.Memory,
-		))
-
-		// pm2_cpu_percent
-		cpuLines = append(cpuLines, fmt.Sprintf(
-			`pm2_cpu_percent{process="%s",pid="%s"} %.2f`,
-			p.Name, pidStr, p.Monit.CPU,
-		))
-
-		// pm2_uptime_seconds
+		ch <- prometheus.MustNewConstMetric(c.branchInfo, prometheus.GaugeValue, branchValue,
+			lv(p.PM2Env.Versioning.Branch, p.PM2Env.Versioning.Revision, p.PM2Env.Versioning.Comment)...)
+
+		ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(p.Monit.Memory), lv()...)
+		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.GaugeValue, p.Monit.CPU, lv()...)
+
+		var uptimeSec float64
 		if p.PM2Env.PmUptime > 0 {
 			msSince := time.Now().UnixMilli() - p.PM2Env.PmUptime
 			if msSince < 0 {
 				msSince = 0
 			}
-			uptimeSec := float64(msSince) / 1000.0
-			uptimeLines = append(uptimeLines, fmt.Sprintf(
-				`pm2_uptime_seconds{process="%s",pid="%s"} %.2f`,
-				p.Name, pidStr, uptimeSec,
-			))
-		} else {
-			uptimeLines = append(uptimeLines, fmt.Sprintf(
-				`pm2_uptime_seconds{process="%s",pid="%s"} 0`,
-				p.Name, pidStr,
-			))
+			uptimeSec = float64(msSince) / 1000.0
 		}
+		ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, uptimeSec, lv()...)
 
-		// pm2_restart_count
-		restartLines = append(restartLines, fmt.Sprintf(
-			`pm2_restart_count{process="%s",pid="%s"} %d`,
-			p.Name, pidStr, p.PM2Env.RestartTime,
-		))
-
-		// pm2_created_at_timestamp
-		createdAtLines = append(createdAtLines, fmt.Sprintf(
-			`pm2_created_at_timestamp{process="%s",pid="%s"} %d`,
-			p.Name, pidStr, p.PM2Env.CreatedAt,
-		))
+		ch <- prometheus.MustNewConstMetric(c.restarts, prometheus.CounterValue, float64(p.PM2Env.RestartTime), lv()...)
+		ch <- prometheus.MustNewConstMetric(c.createdAt, prometheus.GaugeValue, float64(p.PM2Env.CreatedAt), lv()...)
 	}
+}
 
-	// Now group them:
+// HostCollector implements prometheus.Collector for node-level metrics,
+// gathered via gopsutil rather than the PM2 daemon.
+type HostCollector struct {
+	load1    *prometheus.Desc
+	load5    *prometheus.Desc
+	load15   *prometheus.Desc
+	uptime   *prometheus.Desc
+	cpuCount *prometheus.Desc
+	memTotal *prometheus.Desc
+	memAvail *prometheus.Desc
+}
 
-	// pm2_status
-	sb.WriteString(`# HELP pm2_status PM2 App process status: 1 if "online", 0 otherwise; label "status" shows the textual status
-# TYPE pm2_status gauge
-`)
-	for _, line := range statusLines {
-		sb.WriteString(line + "\n")
+// NewHostCollector builds a HostCollector with its metric descriptors.
+func NewHostCollector() *HostCollector {
+	return &HostCollector{
+		load1:    prometheus.NewDesc("pm2_host_load1", "1-minute load average of the host.", nil, nil),
+		load5:    prometheus.NewDesc("pm2_host_load5", "5-minute load average of the host.", nil, nil),
+		load15:   prometheus.NewDesc("pm2_host_load15", "15-minute load average of the host.", nil, nil),
+		uptime:   prometheus.NewDesc("pm2_host_uptime_seconds", "Host uptime in seconds.", nil, nil),
+		cpuCount: prometheus.NewDesc("pm2_host_cpu_count", "Number of logical CPUs on the host.", nil, nil),
+		memTotal: prometheus.NewDesc("pm2_host_memory_total_bytes", "Total physical memory on the host, in bytes.", nil, nil),
+		memAvail: prometheus.NewDesc("pm2_host_memory_available_bytes", "Available physical memory on the host, in bytes.", nil, nil),
 	}
+}
 
-	// pm2_branch_info
-	sb.WriteString(`# HELP pm2_branch_info PM2 App processes branch, revision, and comment: 1 if branch is non-empty, else 0
-# TYPE pm2_branch_info gauge
-`)
-	for _, line := range branchLines {
-		sb.WriteString(line + "\n")
-	}
+// Describe implements prometheus.Collector.
+func (c *HostCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.load1
+	ch <- c.load5
+	ch <- c.load15
+	ch <- c.uptime
+	ch <- c.cpuCount
+	ch <- c.memTotal
+	ch <- c.memAvail
+}
 
-	// pm2_memory_bytes
-	sb.WriteString(`# HELP pm2_memory_bytes PM2 App process memory usage in bytes
-# TYPE pm2_memory_bytes gauge
-`)
-	for _, line := range memoryLines {
-		sb.WriteString(line + "\n")
+// Collect implements prometheus.Collector, querying gopsutil directly on each scrape.
+func (c *HostCollector) Collect(ch chan<- prometheus.Metric) {
+	if avg, err := load.Avg(); err != nil {
+		log.Printf("gopsutil load.Avg error: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.load1, prometheus.GaugeValue, avg.Load1)
+		ch <- prometheus.MustNewConstMetric(c.load5, prometheus.GaugeValue, avg.Load5)
+		ch <- prometheus.MustNewConstMetric(c.load15, prometheus.GaugeValue, avg.Load15)
 	}
 
-	// pm2_cpu_percent
-	sb.WriteString(`# HELP pm2_cpu_percent PM2 App process CPU usage in percentage
-# TYPE pm2_cpu_percent gauge
-`)
-	for _, line := range cpuLines {
-		sb.WriteString(line + "\n")
+	if info, err := host.Info(); err != nil {
+		log.Printf("gopsutil host.Info error: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, float64(info.Uptime))
 	}
 
-	// pm2_uptime_seconds
-	sb.WriteString(`# HELP pm2_uptime_seconds PM2 App process uptime in seconds (calculated from "pm_uptime")
-# TYPE pm2_uptime_seconds gauge
-`)
-	for _, line := range uptimeLines {
-		sb.WriteString(line + "\n")
+	if counts, err := cpu.Counts(true); err != nil {
+		log.Printf("gopsutil cpu.Counts error: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.cpuCount, prometheus.GaugeValue, float64(counts))
 	}
 
-	// pm2_restart_count
-	sb.WriteString(`# HELP pm2_restart_count Number of restarts for a PM2 App process
-# TYPE pm2_restart_count gauge
-`)
-	for _, line := range restartLines {
-		sb.WriteString(line + "\n")
+	if vm, err := mem.VirtualMemory(); err != nil {
+		log.Printf("gopsutil mem.VirtualMemory error: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.memTotal, prometheus.GaugeValue, float64(vm.Total))
+		ch <- prometheus.MustNewConstMetric(c.memAvail, prometheus.GaugeValue, float64(vm.Available))
 	}
+}
 
-	// pm2_created_at_timestamp
-	sb.WriteString(`# HELP pm2_created_at_timestamp PM2 App process creation time in epoch milliseconds
-# TYPE pm2_created_at_timestamp gauge
-`)
-	for _, line := range createdAtLines {
-		sb.WriteString(line + "\n")
+// parsePushGrouping turns "key=value,key=value" into a map, as consumed by
+// push.Pusher.Grouping. Malformed pairs are skipped with a warning rather
+// than failing startup.
+func parsePushGrouping(s string) map[string]string {
+	grouping := map[string]string{}
+	if s == "" {
+		return grouping
 	}
-
-	return sb.String()
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			log.Printf("ignoring malformed --push.grouping pair %q", pair)
+			continue
+		}
+		grouping[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return grouping
 }
 
-// metricsHandler returns the cached data from pm2Data.
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	metrics := buildMetricsText()
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
-	_, _ = w.Write([]byte(metrics))
+// newPusher builds a push.Pusher wired to the exporter's registry, or nil if
+// push-mode wasn't configured via --push.gateway-url.
+func newPusher(registry *prometheus.Registry) *push.Pusher {
+	if *pushGatewayURL == "" {
+		return nil
+	}
+	pusher := push.New(*pushGatewayURL, *pushJob).Gatherer(registry)
+	for k, v := range parsePushGrouping(*pushGrouping) {
+		pusher = pusher.Grouping(k, v)
+	}
+	return pusher
 }
 
-// backgroundPoller runs fetchPM2Data() on a schedule.
-func backgroundPoller(interval time.Duration) {
+// backgroundPoller runs fetchPM2Data() on a schedule, pushing the result to
+// the Pushgateway afterwards when pusher is non-nil.
+func backgroundPoller(interval time.Duration, pusher *push.Pusher) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	// initial fetch
-	if err := fetchPM2Data(); err != nil {
-		log.Printf("Initial fetch error: %v", err)
+	poll := func() {
+		if err := fetchPM2DataTimed(); err != nil {
+			log.Printf("fetchPM2Data error: %v", err)
+			return
+		}
+		if pusher != nil {
+			if err := pusher.Push(); err != nil {
+				log.Printf("failed to push metrics to %s: %v", *pushGatewayURL, err)
+			}
+		}
 	}
 
+	// initial fetch
+	poll()
+
 	for range ticker.C {
-		if err := fetchPM2Data(); err != nil {
-			log.Printf("fetchPM2Data error: %v", err)
-		}
+		poll()
 	}
 }
 
@@ -254,8 +353,13 @@ func customUsage() {
 	fmt.Fprintf(flag.CommandLine.Output(), `
 PM2 Exporter for Prometheus
 
-This exporter calls "pm2 jlist" periodically (default every 30 seconds),
-parses the returned JSON, and exposes the data as Prometheus metrics.
+This exporter polls PM2 periodically (default every 30 seconds) by running
+"pm2 jlist", and exposes the data as Prometheus
+metrics through the standard prometheus.Collector interface (including the
+usual process_* and go_* metrics from the client library). When
+--push.gateway-url is set, the same metrics are additionally pushed to a
+Prometheus Pushgateway after each successful poll, for short-lived PM2
+deployments that Prometheus cannot reliably scrape.
 
 Metrics include:
 - pm2_status (1 if online, 0 otherwise, with label "status")
@@ -263,20 +367,47 @@ Metrics include:
 - pm2_memory_bytes
 - pm2_cpu_percent
 - pm2_uptime_seconds (calculated from pm_uptime)
-- pm2_restart_count
+- pm2_restart_count (counter)
 - pm2_created_at_timestamp
 
-All metrics also have "process" and "pid" labels to differentiate processes.
+All metrics above also have "process" and "pid" labels to differentiate processes.
+
+Host-level metrics (no labels, gathered via gopsutil):
+- pm2_host_load1 / pm2_host_load5 / pm2_host_load15
+- pm2_host_uptime_seconds
+- pm2_host_cpu_count
+- pm2_host_memory_total_bytes / pm2_host_memory_available_bytes
+
+--config.file (optional, hot-reloaded) declares:
+  filters.include/exclude: regexes over PM2 process names
+  extra_labels: static labels attached to every series, e.g. env, datacenter
+  rewrites: pattern -> labels, mapping process-name captures into labels
+            (e.g. "myapp-worker-3" -> app="myapp", role="worker", shard="3")
+Reload outcomes are exposed as pm2_exporter_config_reload_total{result} and
+pm2_exporter_config_last_reload_success_timestamp_seconds.
+
+Scraper health is exposed as pm2_up, pm2_exporter_last_scrape_duration_seconds,
+pm2_exporter_last_scrape_error, pm2_exporter_scrape_failures_total, and
+pm2_exporter_data_age_seconds. --data.max-staleness additionally flips pm2_up
+to 0 once the last successful fetch is older than that threshold.
 
 Usage:
 `)
 	flag.PrintDefaults()
 	fmt.Println(`Example:
   ./pm2_exporter --web.listen-address=":9966" --web.scrape-interval=30
+  ./pm2_exporter --push.gateway-url=http://pushgateway:9091 --push.job=pm2_exporter --push.grouping="instance=web-1"
+  ./pm2_exporter --config.file=/etc/pm2_exporter/config.yml
+  ./pm2_exporter --data.max-staleness=5m
 
 Flags:
   --web.listen-address    Address on which to expose metrics (default ":9966")
-  --web.scrape-interval   How often (seconds) to call "pm2 jlist" (default 30)
+  --web.scrape-interval   How often (seconds) to poll PM2 (default 30)
+  --push.gateway-url      Pushgateway URL to push metrics to after each scrape (disabled if empty)
+  --push.job              Job name to push metrics under (default "pm2_exporter")
+  --push.grouping         Comma-separated key=value grouping labels for the push
+  --config.file           YAML config for process filtering/label remapping, hot-reloaded (disabled if empty)
+  --data.max-staleness    Max age of last-good data before pm2_up flips to 0 (default 0, disabled)
   --help                  Show this help text`)
 }
 
@@ -290,11 +421,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Start background fetch
-	go backgroundPoller(time.Duration(*scrapeInterval) * time.Second)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewHostCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(configReloadTotal)
+	registry.MustRegister(configReloadLastSuccess)
+	registry.MustRegister(NewHealthCollector())
+	registry.MustRegister(scrapeFailuresTotal)
+
+	rebuildPM2Collector(registry, currentConfig())
+	if *configFile != "" {
+		reloadConfig(*configFile, registry)
+		go watchConfigFile(*configFile, registry)
+	}
+
+	pusher := newPusher(registry)
+	if pusher != nil {
+		log.Printf("Pushing metrics to %s as job %q", *pushGatewayURL, *pushJob)
+	}
+
+	// Start background fetch (and push, if configured)
+	go backgroundPoller(time.Duration(*scrapeInterval)*time.Second, pusher)
 
-	// HTTP route
-	http.HandleFunc("/metrics", metricsHandler)
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 
 	log.Printf("Starting PM2 exporter on %s, scraping every %d seconds...", *listenAddress, *scrapeInterval)
 	err := http.ListenAndServe(*listenAddress, nil)